@@ -0,0 +1,258 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+var (
+	cacheMaxBytes         = flag.Int64("cacheMaxBytes", 0, "if > 0, evict least-recently-used workspace cache entries once the total size of retained, unreferenced clones under -cacheDirectory exceeds this many bytes")
+	cacheTTL              = flag.Duration("cacheTTL", 0, "if > 0, evict a workspace cache entry this long after its last session disconnects, even if -cacheMaxBytes hasn't been hit")
+	cacheEvictionInterval = flag.Duration("cacheEvictionInterval", time.Minute, "how often to sweep the workspace cache for entries to evict under -cacheTTL/-cacheMaxBytes")
+)
+
+// workspaceCacheEntry is one retained, on-disk workspace clone, keyed by
+// workspacePoolKey. Entries are removed immediately on eviction, but only
+// once refs drops to zero: a session currently using the clone (refs > 0)
+// is never evicted out from under it.
+type workspaceCacheEntry struct {
+	key        string
+	dir        string
+	sizeBytes  int64
+	refs       int
+	lastUsedAt time.Time // updated when refs returns to zero
+}
+
+// workspaceCacheManager tracks retained workspace clones across sessions so
+// a reconnecting client (or a second client opening the same workspace) can
+// reuse another session's clone instead of cloning its own, and evicts old
+// entries under -cacheTTL/-cacheMaxBytes instead of deleting a workspace's
+// clone the moment its one session disconnects.
+type workspaceCacheManager struct {
+	mu      sync.Mutex
+	entries map[string]*workspaceCacheEntry
+}
+
+var workspaceCache = &workspaceCacheManager{entries: map[string]*workspaceCacheEntry{}}
+
+// acquire returns the still-cached directory for key and marks it in use, if
+// one exists. The caller must call release(key) once it's done with the
+// directory (i.e. when its session ends), mirroring serverPoolRegistry's
+// acquire/release pairing.
+func (c *workspaceCacheManager) acquire(key string) (dir string, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	e.refs++
+	return e.dir, true
+}
+
+// register records a newly-cloned workspace under key, in use by the
+// session that just cloned it, and returns the directory that should
+// actually be treated as canonical for key. Usually that's just dir, but if
+// another session already registered key first (two sessions racing the
+// same new workspace), the existing entry's refs are bumped instead of
+// being overwritten, dir is now an orphaned duplicate clone no cache entry
+// points to, and it's removed here rather than leaking on disk forever.
+func (c *workspaceCacheManager) register(key, dir string, sizeBytes int64) (canonicalDir string) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		e.refs++
+		canonicalDir = e.dir
+		c.mu.Unlock()
+
+		if canonicalDir != dir {
+			if err := os.RemoveAll(dir); err != nil {
+				log.Printf("CloneProxy: removing orphaned duplicate workspace clone %q failed: %s", dir, err)
+			}
+		}
+		return canonicalDir
+	}
+
+	c.entries[key] = &workspaceCacheEntry{
+		key:       key,
+		dir:       dir,
+		sizeBytes: sizeBytes,
+		refs:      1,
+	}
+	c.mu.Unlock()
+	return dir
+}
+
+// release drops this session's reference to the cache entry for key. The
+// entry's on-disk clone is retained, eligible for reuse by acquire or
+// eviction by evictExpired/evictForSpace, until a later sweep removes it.
+func (c *workspaceCacheManager) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	e.refs--
+	if e.refs <= 0 {
+		e.refs = 0
+		e.lastUsedAt = time.Now()
+	}
+}
+
+// evictExpired removes every unreferenced entry whose lastUsedAt is older
+// than ttl.
+func (c *workspaceCacheManager) evictExpired(ttl time.Duration) {
+	c.mu.Lock()
+	var toRemove []*workspaceCacheEntry
+	cutoff := time.Now().Add(-ttl)
+	for key, e := range c.entries {
+		if e.refs == 0 && e.lastUsedAt.Before(cutoff) {
+			toRemove = append(toRemove, e)
+			delete(c.entries, key)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, e := range toRemove {
+		removeWorkspaceCacheDir(e)
+	}
+}
+
+// evictForSpace removes unreferenced entries, least-recently-used first,
+// until the total size of retained, unreferenced entries is at most
+// maxBytes, or there's nothing left that's safe to evict. Entries still in
+// use (refs > 0) don't count against maxBytes at all: they can't be evicted
+// regardless of size, so counting them would chase an unreachable target
+// and evict every idle entry on every sweep once in-use workspaces alone
+// exceed maxBytes.
+func (c *workspaceCacheManager) evictForSpace(maxBytes int64) {
+	c.mu.Lock()
+	var total int64
+	var candidates []*workspaceCacheEntry
+	for _, e := range c.entries {
+		if e.refs == 0 {
+			total += e.sizeBytes
+			candidates = append(candidates, e)
+		}
+	}
+	sortByLastUsed(candidates)
+
+	var toRemove []*workspaceCacheEntry
+	for _, e := range candidates {
+		if total <= maxBytes {
+			break
+		}
+		delete(c.entries, e.key)
+		total -= e.sizeBytes
+		toRemove = append(toRemove, e)
+	}
+	c.mu.Unlock()
+
+	for _, e := range toRemove {
+		removeWorkspaceCacheDir(e)
+	}
+}
+
+// sortByLastUsed orders candidates oldest-lastUsedAt-first, in place.
+func sortByLastUsed(candidates []*workspaceCacheEntry) {
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUsedAt.Before(candidates[j].lastUsedAt)
+	})
+}
+
+// removeWorkspaceCacheDir deletes an evicted entry's on-disk clone. This is
+// a plain os.RemoveAll rather than p.removeWorkspaceCache, since eviction
+// runs in the background with no associated session to call it on.
+func removeWorkspaceCacheDir(e *workspaceCacheEntry) {
+	if err := os.RemoveAll(e.dir); err != nil {
+		log.Printf("CloneProxy: evicting workspace cache entry %q failed: %s", e.key, err)
+	}
+}
+
+// runEvictionLoop periodically sweeps the workspace cache for entries to
+// evict under ttl/maxBytes, until done is closed. Either bound being zero
+// disables that half of the sweep, matching -cacheTTL/-cacheMaxBytes's
+// "0 means disabled" default.
+func runEvictionLoop(interval, ttl time.Duration, maxBytes int64, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if ttl > 0 {
+				workspaceCache.evictExpired(ttl)
+			}
+			if maxBytes > 0 {
+				workspaceCache.evictForSpace(maxBytes)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// reuseCachedWorkspace looks up initReq's workspace in the retained cache
+// and, if found, adopts its directory instead of cloning a fresh one. On
+// success p.cacheKey is set so the session's teardown releases rather than
+// deletes the entry (see the accept loop in proxy.go).
+func (p *cloneProxy) reuseCachedWorkspace(initReq *jsonrpc2.Request) (dir string, ok bool) {
+	key, err := workspacePoolKey(initReq)
+	if err != nil {
+		return "", false
+	}
+
+	dir, found := workspaceCache.acquire(key)
+	if !found {
+		return "", false
+	}
+	p.cacheKey = key
+	return dir, true
+}
+
+// registerClonedWorkspace records the workspace this session just cloned
+// into the retained cache, keyed by initReq's workspacePoolKey, so a later
+// session opening the same workspace can reuse it via reuseCachedWorkspace
+// instead of cloning its own. p.cacheKey is left unset if initReq has no
+// usable rootUri/rootPath, in which case the session falls back to the old
+// per-session cleanup on teardown.
+//
+// If another session raced this one and registered the same key first,
+// register reports that session's directory as canonical and removes this
+// session's own clone; p.cachedWorkspaceDir is set to the canonical
+// directory so this session still uses the right files.
+func (p *cloneProxy) registerClonedWorkspace(initReq *jsonrpc2.Request) {
+	key, err := workspacePoolKey(initReq)
+	if err != nil {
+		return
+	}
+
+	ownDir := p.workspaceCacheDir()
+	sizeBytes, err := dirSizeBytes(ownDir)
+	if err != nil {
+		p.log.Warnf("registerClonedWorkspace: measuring cloned workspace size failed", "error", err)
+	}
+
+	dir := workspaceCache.register(key, ownDir, sizeBytes)
+	if dir != ownDir {
+		p.cachedWorkspaceDir = dir
+	}
+	p.cacheKey = key
+}
+
+// releaseCachedWorkspace drops this session's reference to its retained
+// workspace cache entry (see the accept loop in proxy.go). A no-op if the
+// session never acquired or registered one.
+func (p *cloneProxy) releaseCachedWorkspace() {
+	if p.cacheKey == "" {
+		return
+	}
+	workspaceCache.release(p.cacheKey)
+}
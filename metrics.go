@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricsAddr           = flag.String("metricsAddr", "", "server listen address for a dedicated Prometheus /metrics endpoint. If empty, /metrics is instead served alongside -pprofAddr; if both are empty, metrics aren't served (but are still collected in-process).")
+	cacheSizePollInterval = flag.Duration("cacheSizePollInterval", 30*time.Second, "how often to recompute the cacheDirectoryBytes gauge by walking -cacheDirectory")
+)
+
+// Prometheus collectors for the proxy. These exist for operators running
+// the adapter as a shared, long-lived service (e.g. with -serverPool) who
+// need to alert on stuck language servers and size the cache disk, rather
+// than grepping per-session event logs (see tracelog.go) after the fact.
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lsp_adapter_requests_total",
+		Help: "JSON-RPC requests and notifications relayed by roundTripper.roundTrip, by method and direction.",
+	}, []string{"method", "direction"})
+
+	roundTripLatencySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lsp_adapter_round_trip_latency_seconds",
+		Help:    "Latency of roundTripper.roundTrip, from forwarding a request to relaying its reply.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "direction"})
+
+	errorResponsesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lsp_adapter_error_responses_total",
+		Help: "JSON-RPC error responses seen by roundTripper.roundTrip, by method and jsonrpc2.Error.Code.",
+	}, []string{"method", "code"})
+
+	activeSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "lsp_adapter_active_sessions",
+		Help: "Number of client sessions currently being served.",
+	})
+
+	workspaceCloneSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "lsp_adapter_workspace_clone_seconds",
+		Help:    "Duration of cloneWorkspaceToCache calls.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	beforeInitHookSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "lsp_adapter_before_initialize_hook_seconds",
+		Help:    "Duration of -beforeInitializeHook invocations.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	cacheDirectoryBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "lsp_adapter_cache_directory_bytes",
+		Help: "Total size on disk of -cacheDirectory, recomputed every -cacheSizePollInterval.",
+	})
+)
+
+// mountMetricsHandler registers the Prometheus /metrics handler on mux, for
+// use both by metricsServer (-metricsAddr) and by debugServer (-pprofAddr),
+// whichever the operator configured.
+func mountMetricsHandler(mux *http.ServeMux) {
+	mux.Handle("/metrics", promhttp.Handler())
+}
+
+// metricsServer serves Prometheus metrics at addr (-metricsAddr), for
+// operators who want /metrics on a different listener than -pprofAddr
+// (e.g. so it can sit behind a different ACL).
+func metricsServer(addr string) {
+	mux := http.NewServeMux()
+	mountMetricsHandler(mux)
+
+	log.Printf("CloneProxy: metrics server listening at %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Println("CloneProxy: metrics server failed:", err)
+	}
+}
+
+// dirSizeBytes returns the total size of the regular files under dir. It's
+// best-effort: a file vanishing mid-walk (e.g. a workspace cache entry
+// being evicted concurrently, see cache.go) is not treated as fatal.
+func dirSizeBytes(dir string) (int64, error) {
+	var total int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// pollCacheDirectorySize recomputes cacheDirectoryBytes by walking dir every
+// interval, until done is closed.
+func pollCacheDirectorySize(dir string, interval time.Duration, done <-chan struct{}) {
+	update := func() {
+		total, err := dirSizeBytes(dir)
+		if err != nil {
+			log.Println("CloneProxy: walking -cacheDirectory for metrics failed:", err)
+			return
+		}
+		cacheDirectoryBytes.Set(float64(total))
+	}
+
+	update()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			update()
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// sharedServer is one language server process shared by every cloneProxy
+// session whose client connected to the same workspace (see -serverPool).
+// Client JSON-RPC IDs are rewritten onto globalRequestID so concurrent
+// sessions never collide on the shared conn (see roundTripper.onIDRewrite),
+// and requests/notifications coming back from the server are fanned out to
+// every attached session by sharedServer.handle.
+type sharedServer struct {
+	key  string // workspace key this server was acquired for, see workspacePoolKey
+	conn *jsonrpc2.Conn
+
+	globalRequestID *atomicCounter
+
+	mu               sync.Mutex
+	attached         map[uuid.UUID]*cloneProxy
+	folderURIs       map[uuid.UUID]string // session -> workspace folder URI, for sessions that joined via didChangeWorkspaceFolders
+	cacheDir         string               // the single on-disk workspace every attached session's files live in
+	initializeResult *json.RawMessage     // the real 'initialize' response, replayed to sessions that join later
+}
+
+func (s *sharedServer) attach(p *cloneProxy, folderURI string) {
+	s.mu.Lock()
+	s.attached[p.sessionID] = p
+	if folderURI != "" {
+		s.folderURIs[p.sessionID] = folderURI
+	}
+	s.mu.Unlock()
+}
+
+// handle is the jsonrpc2.Handler for the shared server conn. Notifications
+// like $/progress and textDocument/publishDiagnostics are fanned out to
+// every attached session (they all share the same on-disk workspace, so all
+// of them are relevant recipients). Server-initiated requests are routed to
+// one attached session, since there's no general way to know which client a
+// request like window/showMessageRequest is "for".
+func (s *sharedServer) handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	s.mu.Lock()
+	sessions := make([]*cloneProxy, 0, len(s.attached))
+	for _, p := range s.attached {
+		sessions = append(sessions, p)
+	}
+	s.mu.Unlock()
+
+	if len(sessions) == 0 {
+		return
+	}
+
+	if req.Notif {
+		for _, p := range sessions {
+			p.handleServerRequest(ctx, conn, req)
+		}
+		return
+	}
+
+	sessions[len(sessions)-1].handleServerRequest(ctx, conn, req)
+}
+
+// serverPoolRegistry is the process-wide registry of shared language
+// servers, keyed by workspace.
+type serverPoolRegistry struct {
+	mu      sync.Mutex
+	servers map[string]*sharedServer
+}
+
+var serverPoolReg = &serverPoolRegistry{servers: map[string]*sharedServer{}}
+
+// acquire returns the sharedServer for key, spawning one (via newLSConn) if
+// this is the first session to reference that workspace. created reports
+// which of those happened, so the caller knows whether to actually forward
+// 'initialize' or translate it into a workspace/didChangeWorkspaceFolders
+// 'add' against an already-running server.
+func (r *serverPoolRegistry) acquire(key string, newLSConn func() (io.ReadWriteCloser, error), connOpts []jsonrpc2.ConnOpt) (srv *sharedServer, created bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s, ok := r.servers[key]; ok {
+		return s, false, nil
+	}
+
+	s := &sharedServer{
+		key:             key,
+		globalRequestID: newAtomicCounter(),
+		attached:        map[uuid.UUID]*cloneProxy{},
+		folderURIs:      map[uuid.UUID]string{},
+	}
+
+	lsConn, err := newLSConn()
+	if err != nil {
+		return nil, false, err
+	}
+
+	s.conn = jsonrpc2.NewConn(context.Background(), jsonrpc2.NewBufferedStream(lsConn, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2.AsyncHandler(jsonrpc2HandlerFunc(s.handle)), connOpts...)
+
+	r.servers[key] = s
+	return s, true, nil
+}
+
+// release detaches sessionID from the shared server for key. If other
+// sessions are still attached, the server is just told the session's
+// workspace folder went away, if it had one (the session that created the
+// server has none, so nothing is sent for it). If sessionID was the last
+// one attached, the shared server is actually told to shut down, its conn is closed, and it's removed from the
+// registry.
+func (r *serverPoolRegistry) release(key string, sessionID uuid.UUID, ctx context.Context) {
+	r.mu.Lock()
+	s, ok := r.servers[key]
+	var folderURI string
+	var remaining int
+	if ok {
+		s.mu.Lock()
+		folderURI = s.folderURIs[sessionID]
+		delete(s.attached, sessionID)
+		delete(s.folderURIs, sessionID)
+		remaining = len(s.attached)
+		s.mu.Unlock()
+		if remaining == 0 {
+			delete(r.servers, key)
+		}
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if remaining > 0 {
+		if folderURI == "" {
+			return
+		}
+		err := s.conn.Notify(ctx, "workspace/didChangeWorkspaceFolders", map[string]interface{}{
+			"event": map[string]interface{}{
+				"added":   []map[string]string{},
+				"removed": []map[string]string{{"uri": folderURI, "name": sessionID.String()}},
+			},
+		})
+		if err != nil {
+			log.Printf("CloneProxy: notifying pooled server %q of removed workspace folder failed: %s", key, err)
+		}
+		return
+	}
+
+	var result interface{}
+	if err := s.conn.Call(ctx, "shutdown", nil, &result); err != nil {
+		log.Printf("CloneProxy: shutdown request to pooled language server %q failed: %s", key, err)
+	}
+	if err := s.conn.Notify(ctx, "exit", nil); err != nil {
+		log.Printf("CloneProxy: exit notification to pooled language server %q failed: %s", key, err)
+	}
+	s.conn.Close()
+}
+
+// workspacePoolKey derives a stable -serverPool registry key from an
+// 'initialize' request's rootUri (falling back to the deprecated rootPath),
+// combined with the configured -glob, so two clients opening the same
+// workspace with the same file filter are multiplexed onto the same shared
+// server.
+func workspacePoolKey(initReq *jsonrpc2.Request) (string, error) {
+	var params struct {
+		RootURI  string `json:"rootUri"`
+		RootPath string `json:"rootPath"`
+	}
+	if initReq.Params != nil {
+		if err := json.Unmarshal(*initReq.Params, &params); err != nil {
+			return "", errors.Wrap(err, "unmarshalling initialize params failed")
+		}
+	}
+
+	root := params.RootURI
+	if root == "" {
+		root = params.RootPath
+	}
+	if root == "" {
+		return "", errors.New("initialize request has neither rootUri nor rootPath")
+	}
+
+	h := sha256.Sum256([]byte(root + "\x00" + *glob))
+	return hex.EncodeToString(h[:]), nil
+}
+
+// joinServerPool resolves (or creates) the sharedServer for this session's
+// workspace and adopts it as p.server. It reports whether the session
+// joined an already-running shared server: if so, it has already folded
+// this session into the server via workspace/didChangeWorkspaceFolders and
+// replied to the client directly, and the caller must not forward
+// 'initialize' itself.
+func (p *cloneProxy) joinServerPool(ctx context.Context, initReq *jsonrpc2.Request) (joined bool, err error) {
+	key, err := workspacePoolKey(initReq)
+	if err != nil {
+		return false, errors.Wrap(err, "determining workspace pool key failed")
+	}
+
+	// -jsonrpc2IDRewrite is forced to "number" once, in main(), when
+	// -serverPool is set: it can't be done here, since every session's
+	// goroutine reads *jsonrpc2IDRewrite concurrently (see roundTripper) and
+	// this runs per connection, not once at startup.
+
+	var serverConnOpts []jsonrpc2.ConnOpt
+	if *trace {
+		serverConnOpts = append(serverConnOpts, jsonrpc2.LogMessages(log.New(os.Stderr, fmt.Sprintf("TRACE pool:%s ", key[:12]), log.Ltime)))
+	}
+	if *pprofAddr != "" {
+		// Tagged with the creating session's ID: the shared conn only ever
+		// gets one set of hooks, bound once here when it's first spawned, not
+		// re-bound per session that later joins via didChangeWorkspaceFolders.
+		serverConnOpts = append(serverConnOpts, traceRequests(p.sessionID.String()), traceEventLog("server", p.sessionID.String()))
+	}
+
+	srv, created, err := serverPoolReg.acquire(key, func() (io.ReadWriteCloser, error) {
+		return p.spawnLanguageServer(context.Background())
+	}, serverConnOpts)
+	if err != nil {
+		return false, err
+	}
+
+	p.sharedServer = srv
+	p.server = srv.conn
+	p.lastRequestID = srv.globalRequestID
+
+	if created {
+		srv.attach(p, "")
+		return false, nil
+	}
+
+	srv.mu.Lock()
+	cacheDir := srv.cacheDir
+	result := srv.initializeResult
+	srv.mu.Unlock()
+
+	folderURI := string(filePathToURI(cacheDir))
+	srv.attach(p, folderURI)
+
+	err = p.server.Notify(ctx, "workspace/didChangeWorkspaceFolders", map[string]interface{}{
+		"event": map[string]interface{}{
+			"added":   []map[string]string{{"uri": folderURI, "name": p.sessionID.String()}},
+			"removed": []map[string]string{},
+		},
+	})
+	if err != nil {
+		p.log.Errorf("joinServerPool: notifying pooled server of new workspace folder failed", "error", err)
+	}
+
+	if result != nil {
+		if err := p.client.Reply(ctx, initReq.ID, result); err != nil {
+			p.log.Errorf("joinServerPool: replying to client's initialize with pooled result failed", "error", err)
+		}
+	}
+
+	return true, nil
+}
+
+// effectiveCacheDir returns the on-disk workspace directory this session's
+// files actually live in: its own (p.workspaceCacheDir()) normally, or the
+// shared server's if this session joined a -serverPool server that another
+// session already cloned the workspace for.
+func (p *cloneProxy) effectiveCacheDir() string {
+	if p.sharedServer != nil {
+		p.sharedServer.mu.Lock()
+		defer p.sharedServer.mu.Unlock()
+		if p.sharedServer.cacheDir != "" {
+			return p.sharedServer.cacheDir
+		}
+	}
+	// Also non-empty when this session reused another session's still-cached
+	// workspace clone instead of cloning its own (see cache.go).
+	if p.cachedWorkspaceDir != "" {
+		return p.cachedWorkspaceDir
+	}
+	return p.workspaceCacheDir()
+}
+
+// filePathToURI converts an absolute filesystem path into a file:// URI,
+// the shape LSP expects for a WorkspaceFolder's uri field.
+func filePathToURI(path string) lsp.DocumentURI {
+	return lsp.DocumentURI((&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String())
+}
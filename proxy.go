@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -15,7 +16,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/google/uuid"
 	multierror "github.com/hashicorp/go-multierror"
@@ -25,7 +28,7 @@ import (
 )
 
 var (
-	proxyAddr          = flag.String("proxyAddress", "127.0.0.1:8080", "proxy server listen address (tcp)")
+	proxyAddr          = flag.String("proxyAddress", "127.0.0.1:8080", "proxy server listen address. Accepts a bare tcp host:port (legacy default), or a URI: tcp://host:port, unix:///path/to.sock, or stdio:// to expose the adapter itself over stdio.")
 	pprofAddr          = flag.String("pprofAddr", "", "server listen address for pprof")
 	cacheDir           *string
 	unresolvedCacheDir = flag.String("cacheDirectory", filepath.Join(os.TempDir(), "proxy-cache"), "cache directory location")
@@ -34,18 +37,54 @@ var (
 	glob               = flag.String("glob", "", "A colon (:) separated list of file globs to sync locally. By default we place all files into the workspace, but some language servers may only look at a subset of files. Specifying this allows us to avoid syncing all files. Note: This is done by basename only.")
 	beforeInitHook     = flag.String("beforeInitializeHook", "", "A program to run after cloning the repository, but before the 'initialize' call is forwarded to the language server. (For example, you can use this to run a script to install dependencies for the project). The program's cwd will be the workspace's cache directory, and it will also be passed the cache directory as an argument.")
 	trace              = flag.Bool("trace", true, "trace logs to stderr")
+	shutdownTimeout    = flag.Duration("shutdownTimeout", 30*time.Second, "maximum time to wait for in-flight sessions to drain during a graceful shutdown before forcing an exit")
+	serverPoolEnabled  = flag.Bool("serverPool", false, "If true, share a single language server process per workspace (keyed by the 'initialize' rootUri/rootPath plus -glob) across client connections instead of spawning a new one per client. Reduces cold-start latency for slow-to-warm servers such as rust-analyzer, gopls, or clangd. Forces -jsonrpc2IDRewrite if it is \"none\".")
+	logLevelFlag       = flag.String("logLevel", "info", "minimum level of structured per-session log lines to emit: debug, info, warn, or error")
+	logFormatFlag      = flag.String("logFormat", "text", "format for structured per-session log lines: text (human-readable) or json")
+	eventLogSize       = flag.Int("eventLogSize", 200, "number of recent JSON-RPC exchanges to retain per session for the -pprofAddr /sessions/{id}/events endpoint")
 )
 
 type cloneProxy struct {
 	client *jsonrpc2.Conn // connection to the browser
 	server *jsonrpc2.Conn // connection to the language server
 
-	sessionID     uuid.UUID      // unique ID for this session
-	lastRequestID *atomicCounter // counter that is incremented for each new request that is sent across the wire for this session
+	sessionID     uuid.UUID         // unique ID for this session
+	lastRequestID *atomicCounter    // counter that is incremented for each new request that is sent across the wire for this session
+	log           *structuredLogger // structured logger tagged with this session's sessionID (see rootLogger)
 
 	ready chan struct{} // barrier to block handling requests until the proxy is fully initialized
 	ctx   context.Context
 
+	// spawnLanguageServer establishes a fresh connection to this session's
+	// language server backend. It's only actually invoked when this session
+	// needs its own process (-serverPool off, or the first session for a
+	// given -serverPool workspace).
+	spawnLanguageServer func(context.Context) (io.ReadWriteCloser, error)
+
+	// sharedServer is non-nil when -serverPool is enabled and this session
+	// has been multiplexed onto a language server shared with other
+	// sessions for the same workspace.
+	sharedServer *sharedServer
+
+	// cacheKey is the workspace cache registry key (see cache.go) this
+	// session's workspace was cloned or reused under, set once 'initialize'
+	// is handled. Empty if the 'initialize' request had no rootUri/rootPath
+	// to key on, in which case the workspace cache is not used for it.
+	cacheKey string
+
+	// cachedWorkspaceDir is non-empty when this session reused another,
+	// still-cached session's workspace clone (see reuseCachedWorkspace)
+	// instead of cloning its own; effectiveCacheDir prefers it over
+	// workspaceCacheDir.
+	cachedWorkspaceDir string
+
+	// idMap tracks, for requests currently in flight to the server, the
+	// rewritten ID (see -jsonrpc2IDRewrite and roundTripper.onIDRewrite) we
+	// actually sent for each client-issued request ID, so that a later
+	// '$/cancelRequest' referencing the client's ID can be translated.
+	idMapMu sync.Mutex
+	idMap   map[jsonrpc2.ID]jsonrpc2.ID
+
 	// HACK
 	didOpenMu sync.Mutex
 	didOpen   map[string]bool
@@ -81,6 +120,22 @@ func main() {
 		log.Fatalf("Invalid jsonrpc2IDRewrite value %q", *jsonrpc2IDRewrite)
 	}
 
+	if *serverPoolEnabled && *jsonrpc2IDRewrite == "none" {
+		log.Println("CloneProxy: -serverPool requires jsonrpc2 ID rewriting to avoid collisions between multiplexed sessions; forcing -jsonrpc2IDRewrite=number")
+		*jsonrpc2IDRewrite = "number"
+	}
+
+	switch *logFormatFlag {
+	case "text", "json":
+	default:
+		log.Fatalf("Invalid logFormat value %q", *logFormatFlag)
+	}
+	logLevel, err := parseLogLevel(*logLevelFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rootLogger = newStructuredLogger(os.Stderr, logLevel, *logFormatFlag)
+
 	// Ensure the path exists, otherwise symlinks to it cannot be resolved.
 	if err := os.MkdirAll(*unresolvedCacheDir, os.ModePerm); err != nil {
 		log.Fatalf("Error when checking -cacheDirectory=%q to check if it exists: %s", *unresolvedCacheDir, err)
@@ -95,9 +150,8 @@ func main() {
 	}
 	cacheDir = &resolvedCacheDir
 
-	lis, err := net.Listen("tcp", *proxyAddr)
+	lis, err := listen(*proxyAddr)
 	if err != nil {
-		err = errors.Wrap(err, "setting up proxy listener failed")
 		log.Fatal(err)
 	}
 
@@ -106,26 +160,133 @@ func main() {
 	if *pprofAddr != "" {
 		go debugServer(*pprofAddr)
 	}
+	if *metricsAddr != "" {
+		go metricsServer(*metricsAddr)
+	}
+
+	cacheSizePollDone := make(chan struct{})
+	go pollCacheDirectorySize(*cacheDir, *cacheSizePollInterval, cacheSizePollDone)
+	defer close(cacheSizePollDone)
+
+	if *cacheTTL > 0 || *cacheMaxBytes > 0 {
+		cacheEvictionDone := make(chan struct{})
+		go runEvictionLoop(*cacheEvictionInterval, *cacheTTL, *cacheMaxBytes, cacheEvictionDone)
+		defer close(cacheEvictionDone)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	shutdown := func() {
-		cancel()
-		lis.Close()
+	var wg sync.WaitGroup
 
-		// Remove the entire cache when the program is exiting
-		os.RemoveAll(*cacheDir)
+	var sessionsMu sync.Mutex
+	sessions := map[uuid.UUID]*cloneProxy{}
+
+	// stopAccept closes the listener and signals the accept loop below to
+	// stop treating the resulting error as fatal, without tearing down
+	// already-accepted sessions (which are derived from ctx, cancelled
+	// separately once they've drained).
+	var stopAcceptOnce sync.Once
+	stopAccepting := make(chan struct{})
+	stopAccept := func() {
+		stopAcceptOnce.Do(func() {
+			close(stopAccepting)
+			lis.Close()
+		})
 	}
 
-	defer shutdown()
-	go trapSignalsForShutdown(shutdown)
+	var reExeced int32
+
+	var gracefulShutdownOnce sync.Once
+	gracefulShutdown := func() {
+		gracefulShutdownOnce.Do(func() {
+			log.Println("CloneProxy: shutdown requested, draining active sessions")
+
+			// Stop accepting new connections immediately.
+			stopAccept()
+
+			// Snapshot the sessions under the lock, then release it before
+			// making any blocking RPCs below: holding sessionsMu across
+			// network I/O would stall every concurrent session's own
+			// teardown (accept loop's "delete(sessions, ...)" also takes
+			// this lock) until the whole notify loop finished. Mirrors
+			// sharedServer.handle's snapshot-then-unlock pattern in pool.go.
+			sessionsMu.Lock()
+			toNotify := make([]*cloneProxy, 0, len(sessions))
+			for _, proxy := range sessions {
+				toNotify = append(toNotify, proxy)
+			}
+			sessionsMu.Unlock()
 
-	var wg sync.WaitGroup
+			for _, proxy := range toNotify {
+				if proxy.sharedServer != nil {
+					serverPoolReg.release(proxy.sharedServer.key, proxy.sessionID, ctx)
+				} else {
+					proxy.requestServerShutdown(ctx)
+				}
+			}
+
+			drained := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(drained)
+			}()
+
+			select {
+			case <-drained:
+				cancel()
+
+				// If we handed the listening socket off to a re-exec'd
+				// child, the child is relying on this cache dir and must
+				// not have it removed out from under it. Otherwise, every
+				// session has actually drained above, so it's safe to
+				// remove it now.
+				if atomic.LoadInt32(&reExeced) == 0 {
+					os.RemoveAll(*cacheDir)
+				}
+			case <-time.After(*shutdownTimeout):
+				// Sessions are still active: don't cancel their contexts or
+				// remove -cacheDirectory out from under them just because a
+				// timer fired, or we'd reintroduce the exact race this
+				// graceful shutdown was meant to avoid. Operators that want
+				// a hard deadline instead of waiting for the drain can still
+				// send a second SIGINT/SIGTERM (see trapSignalsForShutdown).
+				log.Printf("CloneProxy: shutdownTimeout of %s elapsed with sessions still active; leaving them to drain in the background", *shutdownTimeout)
+			}
+		})
+	}
+
+	reExecForUpgrade := func() {
+		child, err := reExec(lis)
+		if err != nil {
+			log.Println("CloneProxy: live-reload re-exec failed, continuing to serve on this process:", err)
+			return
+		}
+
+		log.Printf("CloneProxy: re-exec'd as pid %d, this process will stop accepting new connections and drain", child.Pid)
+		atomic.StoreInt32(&reExeced, 1)
+
+		// The child now owns the listening socket (it inherited a dup'd fd),
+		// so stop accepting new connections here; existing sessions continue
+		// to be served by this process until they finish. A *net.UnixListener
+		// that net.Listen created removes its socket file when closed, which
+		// would leave the child accepting on a path nobody can connect to.
+		if ul, ok := lis.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		stopAccept()
+	}
+
+	defer gracefulShutdown()
+	go trapSignalsForShutdown(gracefulShutdown, reExecForUpgrade)
+
+acceptLoop:
 	for {
 		clientNetConn, err := lis.Accept()
 		if err != nil {
-			if ctx.Err() != nil { // shutdown
-				break
+			select {
+			case <-stopAccepting:
+				break acceptLoop
+			default:
 			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				log.Println("error when accepting client connection: ", err.Error())
@@ -141,49 +302,146 @@ func main() {
 			ctx, cancel := context.WithCancel(ctx)
 			defer cancel()
 
-			var lsConn, err = stdIoLSConn(ctx, lspBin[0], lspBin[1:]...)
-			if err != nil {
-				log.Println("connecting to language server over stdio failed", err.Error())
-				return
-			}
-
 			proxy := &cloneProxy{
 				ready:         make(chan struct{}),
 				ctx:           ctx,
 				sessionID:     uuid.New(),
 				lastRequestID: newAtomicCounter(),
 				didOpen:       map[string]bool{},
+				idMap:         map[jsonrpc2.ID]jsonrpc2.ID{},
 			}
 			traceID := proxy.sessionID.String()
+			proxy.log = rootLogger.with("sessionID", traceID)
 
-			var serverConnOpts []jsonrpc2.ConnOpt
-			if *trace {
-				serverConnOpts = append(serverConnOpts, jsonrpc2.LogMessages(log.New(os.Stderr, fmt.Sprintf("TRACE %s ", traceID), log.Ltime)))
+			if *pprofAddr != "" {
+				registerSessionEventLog(proxy.sessionID, *eventLogSize)
+				defer unregisterSessionEventLog(proxy.sessionID)
 			}
+
+			proxy.spawnLanguageServer = func(ctx context.Context) (io.ReadWriteCloser, error) {
+				return connectToLanguageServer(ctx, lspBin)
+			}
+
+			var clientConnOpts []jsonrpc2.ConnOpt
 			if *pprofAddr != "" {
-				serverConnOpts = append(serverConnOpts, traceRequests(traceID), traceEventLog("server", traceID))
+				clientConnOpts = append(clientConnOpts, traceRequests(traceID), traceEventLog("client", traceID))
+			}
+			proxy.client = jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(clientNetConn, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2.AsyncHandler(jsonrpc2HandlerFunc(proxy.handleClientRequest)), clientConnOpts...)
+
+			if !*serverPoolEnabled {
+				lsConn, err := proxy.spawnLanguageServer(ctx)
+				if err != nil {
+					proxy.log.Errorf("connecting to language server failed", "error", err)
+					return
+				}
+
+				var serverConnOpts []jsonrpc2.ConnOpt
+				if *trace {
+					serverConnOpts = append(serverConnOpts, jsonrpc2.LogMessages(log.New(os.Stderr, fmt.Sprintf("TRACE %s ", traceID), log.Ltime)))
+				}
+				if *pprofAddr != "" {
+					serverConnOpts = append(serverConnOpts, traceRequests(traceID), traceEventLog("server", traceID))
+				}
+				proxy.server = jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(lsConn, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2.AsyncHandler(jsonrpc2HandlerFunc(proxy.handleServerRequest)), serverConnOpts...)
 			}
-			proxy.client = jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(clientNetConn, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2.AsyncHandler(jsonrpc2HandlerFunc(proxy.handleClientRequest)))
-			proxy.server = jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(lsConn, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2.AsyncHandler(jsonrpc2HandlerFunc(proxy.handleServerRequest)), serverConnOpts...)
+			// In -serverPool mode, proxy.server is instead set lazily by
+			// joinServerPool once the client's 'initialize' request reveals
+			// which workspace (and therefore which shared server) it wants.
+
+			sessionsMu.Lock()
+			sessions[proxy.sessionID] = proxy
+			sessionsMu.Unlock()
+			activeSessions.Inc()
+			defer func() {
+				sessionsMu.Lock()
+				delete(sessions, proxy.sessionID)
+				sessionsMu.Unlock()
+				activeSessions.Dec()
+			}()
 
 			proxy.start()
 
-			// When one side of the connection disconnects, close the other side.
-			select {
-			case <-proxy.client.DisconnectNotify():
-				proxy.server.Close()
-			case <-proxy.server.DisconnectNotify():
-				proxy.client.Close()
+			if *serverPoolEnabled {
+				<-proxy.client.DisconnectNotify()
+				if proxy.sharedServer != nil {
+					serverPoolReg.release(proxy.sharedServer.key, proxy.sessionID, proxy.ctx)
+				}
+			} else {
+				// When one side of the connection disconnects, close the other side.
+				select {
+				case <-proxy.client.DisconnectNotify():
+					proxy.server.Close()
+				case <-proxy.server.DisconnectNotify():
+					proxy.client.Close()
+				}
 			}
 
-			// Remove the cache contents for this workspace after the connection closes
-			proxy.cleanWorkspaceCache()
+			// Release this session's workspace cache entry rather than
+			// deleting it outright (see cache.go): it's retained, subject
+			// to -cacheMaxBytes/-cacheTTL eviction, so a reconnecting
+			// client can skip re-cloning. Sessions that never got a cache
+			// key (e.g. 'initialize' had no rootUri/rootPath) fall back to
+			// the old per-session cleanup.
+			if proxy.cacheKey != "" {
+				proxy.releaseCachedWorkspace()
+			} else {
+				proxy.cleanWorkspaceCache()
+			}
 		}(clientNetConn)
 	}
 
 	wg.Wait()
 }
 
+// requestServerShutdown asks this session's language server to shut down
+// cleanly by forwarding the standard LSP 'shutdown'/'exit' sequence, rather
+// than simply severing the connection out from under it.
+func (p *cloneProxy) requestServerShutdown(ctx context.Context) {
+	var result interface{}
+	if err := p.server.Call(ctx, "shutdown", nil, &result); err != nil {
+		p.log.Errorf("shutdown request to language server failed", "error", err)
+	}
+	if err := p.server.Notify(ctx, "exit", nil); err != nil {
+		p.log.Errorf("exit notification to language server failed", "error", err)
+	}
+}
+
+// forwardCancelRequest relays a '$/cancelRequest' notification to the
+// server, remapping the ID it carries to whatever ID we actually assigned
+// the original request (see -jsonrpc2IDRewrite and roundTripper.onIDRewrite).
+// Without this, the server would look up a cancellation for an ID it never
+// saw and silently ignore it.
+func (p *cloneProxy) forwardCancelRequest(ctx context.Context, req *jsonrpc2.Request) {
+	var params struct {
+		ID jsonrpc2.ID `json:"id"`
+	}
+	if req.Params != nil {
+		if err := json.Unmarshal(*req.Params, &params); err != nil {
+			p.log.Errorf("forwardCancelRequest: unmarshalling params failed", "error", err)
+			return
+		}
+	}
+
+	id := params.ID
+	if *jsonrpc2IDRewrite != "none" {
+		p.idMapMu.Lock()
+		rewritten, ok := p.idMap[params.ID]
+		p.idMapMu.Unlock()
+		if !ok {
+			// The request already completed (or we never saw it); nothing
+			// left to cancel.
+			p.log.Debugf("forwardCancelRequest: no in-flight request for id, dropping", "id", params.ID.String())
+			return
+		}
+		id = rewritten
+		p.log.Debugf("forwardCancelRequest: rewrote cancelled id", "original", params.ID.String(), "rewritten", id.String())
+	}
+
+	if err := p.server.Notify(ctx, "$/cancelRequest", map[string]interface{}{"id": id}); err != nil {
+		p.log.Errorf("forwardCancelRequest: notify failed", "error", err)
+	}
+}
+
 func (p *cloneProxy) handleServerRequest(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
 	<-p.ready
 
@@ -191,30 +449,111 @@ func (p *cloneProxy) handleServerRequest(ctx context.Context, conn *jsonrpc2.Con
 		req:             req,
 		globalRequestID: p.lastRequestID,
 
-		src:  p.server,
-		dest: p.client,
+		src:       p.server,
+		dest:      p.client,
+		direction: "server_to_client",
 
-		updateURIFromSrc:  func(uri lsp.DocumentURI) lsp.DocumentURI { return serverToClientURI(uri, p.workspaceCacheDir()) },
-		updateURIFromDest: func(uri lsp.DocumentURI) lsp.DocumentURI { return clientToServerURI(uri, p.workspaceCacheDir()) },
+		updateURIFromSrc:  func(uri lsp.DocumentURI) lsp.DocumentURI { return serverToClientURI(uri, p.effectiveCacheDir()) },
+		updateURIFromDest: func(uri lsp.DocumentURI) lsp.DocumentURI { return clientToServerURI(uri, p.effectiveCacheDir()) },
 	}
 
 	if err := rTripper.roundTrip(ctx); err != nil {
-		log.Println("CloneProxy.handleServerRequest(): roundTrip failed", err)
+		p.log.Errorf("handleServerRequest: roundTrip failed", "method", req.Method, "error", err)
 	}
 }
 
 func (p *cloneProxy) handleClientRequest(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
 	<-p.ready
 
+	if req.Method == "$/cancelRequest" {
+		p.forwardCancelRequest(ctx, req)
+		return
+	}
+
+	if req.Method == "shutdown" && p.sharedServer != nil {
+		// This session is multiplexed onto a server shared with other
+		// sessions: don't actually shut it down unless we're the last one
+		// attached (see serverPoolRegistry.release), and always reply
+		// success locally rather than forwarding 'shutdown' itself, since
+		// the pooled server never saw a matching per-session 'initialize'.
+		serverPoolReg.release(p.sharedServer.key, p.sessionID, ctx)
+		if err := p.client.Reply(ctx, req.ID, nil); err != nil {
+			p.log.Errorf("handleClientRequest: replying to pooled shutdown failed", "error", err)
+		}
+		return
+	}
+
+	if req.Method == "exit" && p.sharedServer != nil {
+		// Every conforming LSP client sends 'exit' right after 'shutdown'.
+		// Don't forward it to the shared server conn like a normal
+		// notification: that would terminate the pooled language server
+		// process out from under every other session still attached to
+		// this workspace. The real 'shutdown'/'exit' sequence against the
+		// pooled server is sent by serverPoolRegistry.release once the last
+		// attached session detaches, so there's nothing left to do here.
+		return
+	}
+
 	if req.Method == "initialize" {
 		globs := strings.FieldsFunc(*glob, func(r rune) bool { return r == ':' })
-		if err := p.cloneWorkspaceToCache(globs); err != nil {
-			log.Println("CloneProxy.handleClientRequest(): cloning workspace failed during initialize", err)
-			return
+
+		if *serverPoolEnabled {
+			joined, err := p.joinServerPool(ctx, req)
+			if err != nil {
+				p.log.Errorf("handleClientRequest: joining server pool failed", "error", err)
+				// p.server is still nil: reply with an error rather than
+				// falling through to roundTrip, which would only return an
+				// error for the nil dest without ever replying to the client.
+				if replyErr := p.client.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{Message: err.Error()}); replyErr != nil {
+					p.log.Errorf("handleClientRequest: replying to client after joinServerPool failure failed", "error", replyErr)
+				}
+				return
+			}
+			if joined {
+				// We attached to an already-running pooled server, which
+				// was told about our workspace via
+				// workspace/didChangeWorkspaceFolders and already replied
+				// to the client with its original initialize result.
+				return
+			}
+			// We're the first session for this workspace: fall through and
+			// clone + forward 'initialize' as normal, against the (freshly
+			// spawned) server that joinServerPool just set as p.server.
+		}
+
+		if dir, reused := p.reuseCachedWorkspace(req); reused {
+			p.cachedWorkspaceDir = dir
+			p.log.Infof("reusing cached workspace clone, skipping clone", "dir", dir)
+		} else {
+			cloneStart := time.Now()
+			err := p.cloneWorkspaceToCache(p.workspaceCacheDir(), globs)
+			workspaceCloneSeconds.Observe(time.Since(cloneStart).Seconds())
+			if err != nil {
+				p.log.Errorf("handleClientRequest: cloning workspace failed during initialize", "error", err)
+				return
+			}
+			p.registerClonedWorkspace(req)
+		}
+		if p.sharedServer != nil {
+			// We're the session that created this pooled server; record the
+			// cache dir we just cloned (or reused) so later sessions that
+			// join this same workspace reuse it instead of cloning again.
+			// Resolved before locking sharedServer.mu, since effectiveCacheDir
+			// would otherwise try to re-acquire it.
+			dir := p.cachedWorkspaceDir
+			if dir == "" {
+				dir = p.workspaceCacheDir()
+			}
+			p.sharedServer.mu.Lock()
+			p.sharedServer.cacheDir = dir
+			p.sharedServer.mu.Unlock()
 		}
 		if *beforeInitHook != "" {
-			if err := p.runHook(ctx, *beforeInitHook); err != nil {
-				log.Println("CloneProxy.handleClientRequest(): running beforeInitializeHook failed", err)
+			hookStart := time.Now()
+			err := p.runHook(ctx, *beforeInitHook)
+			beforeInitHookSeconds.Observe(time.Since(hookStart).Seconds())
+			if err != nil {
+				p.log.Errorf("handleClientRequest: running beforeInitializeHook failed", "error", err)
 			}
 		}
 	} else if req.Method == "workspace/didChangeWorkspaceFolders" {
@@ -232,14 +571,25 @@ func (p *cloneProxy) handleClientRequest(ctx context.Context, conn *jsonrpc2.Con
 				workspaceName := item["name"].(string)
 				err := p.removeWorkspaceCache(workspaceName)
 				if (err != nil) {
-					log.Println("CloneProxy.handleClientRequest(): remove workspace failed during initialize", err)
+					p.log.Errorf("handleClientRequest: removing workspace failed", "error", err)
 				}
 			}
 		}
 
 		if len(addFolders) > 0 {
-			if err := p.cloneWorkspaceToCache(globs); err != nil {
-				log.Println("CloneProxy.handleClientRequest(): cloning workspace failed during initialize", err)
+			// Clone into p.effectiveCacheDir(), not p.workspaceCacheDir():
+			// this session may have skipped its own clone entirely, by
+			// reusing another session's cached one (see reuseCachedWorkspace)
+			// or by joining a -serverPool server (see joinServerPool), in
+			// which case p.workspaceCacheDir() is an unused directory nobody
+			// ever looks at. Every URI this session's traffic is rewritten
+			// against already goes through effectiveCacheDir(); the added
+			// folder's files need to land in that same directory.
+			cloneStart := time.Now()
+			err := p.cloneWorkspaceToCache(p.effectiveCacheDir(), globs)
+			workspaceCloneSeconds.Observe(time.Since(cloneStart).Seconds())
+			if err != nil {
+				p.log.Errorf("handleClientRequest: cloning workspace failed for added folder", "error", err)
 				return
 			}
 		}
@@ -249,11 +599,12 @@ func (p *cloneProxy) handleClientRequest(ctx context.Context, conn *jsonrpc2.Con
 		req:             req,
 		globalRequestID: p.lastRequestID,
 
-		src:  p.client,
-		dest: p.server,
+		src:       p.client,
+		dest:      p.server,
+		direction: "client_to_server",
 
 		updateURIFromSrc: func(uri lsp.DocumentURI) lsp.DocumentURI {
-			uri = clientToServerURI(uri, p.workspaceCacheDir())
+			uri = clientToServerURI(uri, p.effectiveCacheDir())
 
 			// HACK
 			//
@@ -290,8 +641,10 @@ func (p *cloneProxy) handleClientRequest(ctx context.Context, conn *jsonrpc2.Con
 								},
 							})
 							if err != nil {
-								log.Println("error sending didOpen", err)
+								p.log.Warnf("(HACK) sending synthetic didOpen failed", "path", parsedURI.Path, "error", err)
 							}
+						} else {
+							p.log.Warnf("(HACK) reading file for synthetic didOpen failed", "path", parsedURI.Path, "error", err)
 						}
 					}
 				}
@@ -299,11 +652,39 @@ func (p *cloneProxy) handleClientRequest(ctx context.Context, conn *jsonrpc2.Con
 
 			return uri
 		},
-		updateURIFromDest: func(uri lsp.DocumentURI) lsp.DocumentURI { return serverToClientURI(uri, p.workspaceCacheDir()) },
+		updateURIFromDest: func(uri lsp.DocumentURI) lsp.DocumentURI { return serverToClientURI(uri, p.effectiveCacheDir()) },
+
+		onIDRewrite: func(rewritten jsonrpc2.ID) {
+			if *jsonrpc2IDRewrite == "none" {
+				return
+			}
+			p.idMapMu.Lock()
+			p.idMap[req.ID] = rewritten
+			p.idMapMu.Unlock()
+			p.log.Debugf("(HACK) rewrote request id", "method", req.Method, "original", req.ID.String(), "rewritten", rewritten.String())
+		},
+
+		onRawResult: func(raw *json.RawMessage) {
+			if req.Method == "initialize" && p.sharedServer != nil {
+				p.sharedServer.mu.Lock()
+				if p.sharedServer.initializeResult == nil {
+					p.sharedServer.initializeResult = raw
+				}
+				p.sharedServer.mu.Unlock()
+			}
+		},
+	}
+
+	if !req.Notif {
+		defer func() {
+			p.idMapMu.Lock()
+			delete(p.idMap, req.ID)
+			p.idMapMu.Unlock()
+		}()
 	}
 
 	if err := rTripper.roundTrip(ctx); err != nil {
-		log.Println("CloneProxy.handleClientRequest(): roundTrip failed", err)
+		p.log.Errorf("handleClientRequest: roundTrip failed", "method", req.Method, "error", err)
 	}
 }
 
@@ -314,12 +695,46 @@ type roundTripper struct {
 	src  *jsonrpc2.Conn
 	dest *jsonrpc2.Conn
 
+	// direction labels the requestsTotal/roundTripLatencySeconds/
+	// errorResponsesTotal metrics (see metrics.go) with which way this
+	// roundTrip is going: "client_to_server" or "server_to_client".
+	direction string
+
 	updateURIFromSrc  func(lsp.DocumentURI) lsp.DocumentURI
 	updateURIFromDest func(lsp.DocumentURI) lsp.DocumentURI
+
+	// onIDRewrite, if set, is called with the ID actually sent to dest right
+	// before the call is made. This lets a caller track the mapping from
+	// the original src-side ID to the one placed on the wire, so a later
+	// '$/cancelRequest' can be translated, or (for a -serverPool shared
+	// conn) so the right in-flight request can be identified.
+	onIDRewrite func(id jsonrpc2.ID)
+
+	// onRawResult, if set, is called with the server's raw (pre-URI-rewrite)
+	// result before it's relayed to src. Used to cache an 'initialize'
+	// result for replaying to sessions that join an already-running
+	// -serverPool server.
+	onRawResult func(raw *json.RawMessage)
 }
 
 // roundTrip passes requests from one side of the connection to the other.
 func (r *roundTripper) roundTrip(ctx context.Context) error {
+	if r.src == nil || r.dest == nil {
+		// In -serverPool mode p.server stays nil until joinServerPool
+		// succeeds, so client requests other than 'initialize' (which
+		// handleClientRequest answers with an error itself) can get here
+		// with a nil dest. This runs under jsonrpc2.AsyncHandler with no
+		// recover, so a nil Conn here would panic and take down every other
+		// session sharing this process.
+		return errors.Errorf("roundTrip: src or dest conn is nil for method %s", r.req.Method)
+	}
+
+	start := time.Now()
+	requestsTotal.WithLabelValues(r.req.Method, r.direction).Inc()
+	defer func() {
+		roundTripLatencySeconds.WithLabelValues(r.req.Method, r.direction).Observe(time.Since(start).Seconds())
+	}()
+
 	var params interface{}
 	if r.req.Params != nil {
 		if err := json.Unmarshal(*r.req.Params, &params); err != nil {
@@ -344,16 +759,18 @@ func (r *roundTripper) roundTrip(ctx context.Context) error {
 		id = r.req.ID
 	case "string":
 		// Some language servers don't properly support ID's that are ints
-		// (e.x. Clojure), so we provide a string instead. Note that doing this
-		// breaks the `$/cancelRequest` and `$/partialResult` request.
+		// (e.x. Clojure), so we provide a string instead. Note that this
+		// breaks `$/partialResult`; `$/cancelRequest` is handled separately
+		// (see cloneProxy.forwardCancelRequest) by remapping through onIDRewrite below.
 		id = jsonrpc2.ID{
 			Str:      strconv.FormatUint(r.globalRequestID.getAndInc(), 10),
 			IsString: true,
 		}
 	case "number":
 		// Some language servers don't properly support ID's that are strings
-		// (e.x. Rust), so we provide a number instead. Note that doing this
-		// breaks the `$/cancelRequest` and `$/partialResult` request.
+		// (e.x. Rust), so we provide a number instead. Note that this breaks
+		// `$/partialResult`; `$/cancelRequest` is handled separately (see
+		// cloneProxy.forwardCancelRequest) by remapping through onIDRewrite below.
 		id = jsonrpc2.ID{
 			Num: r.globalRequestID.getAndInc(),
 		}
@@ -361,6 +778,10 @@ func (r *roundTripper) roundTrip(ctx context.Context) error {
 		panic("unexpected jsonrpc2IDRewrite " + *jsonrpc2IDRewrite)
 	}
 
+	if r.onIDRewrite != nil {
+		r.onIDRewrite(id)
+	}
+
 	var rawResult *json.RawMessage
 	err := r.dest.Call(ctx, r.req.Method, params, &rawResult, jsonrpc2.PickID(id))
 
@@ -371,6 +792,7 @@ func (r *roundTripper) roundTrip(ctx context.Context) error {
 		} else {
 			respErr = &jsonrpc2.Error{Message: err.Error()}
 		}
+		errorResponsesTotal.WithLabelValues(r.req.Method, strconv.FormatInt(int64(respErr.Code), 10)).Inc()
 
 		var multiErr error = respErr
 
@@ -381,6 +803,10 @@ func (r *roundTripper) roundTrip(ctx context.Context) error {
 		return errors.Wrapf(multiErr, "calling method %s on dest failed", r.req.Method)
 	}
 
+	if r.onRawResult != nil {
+		r.onRawResult(rawResult)
+	}
+
 	var result interface{}
 	if rawResult != nil {
 		if err := json.Unmarshal(*rawResult, &result); err != nil {
@@ -397,16 +823,99 @@ func (r *roundTripper) roundTrip(ctx context.Context) error {
 	return nil
 }
 
-func trapSignalsForShutdown(shutdown func()) {
-	// Listen for shutdown signals. When we receive one attempt to clean up,
-	// but do an insta-shutdown if we receive more than one signal.
+// trapSignalsForShutdown waits for SIGINT/SIGTERM and begins a graceful
+// shutdown, draining in-flight sessions before exiting. SIGHUP and SIGUSR2
+// are treated separately as a request to live-reload (re-exec in place, see
+// reExec) rather than to exit, and do not consume the "first signal" below.
+// A second SIGINT/SIGTERM is still an insta-exit escape hatch for operators
+// that don't want to wait out -shutdownTimeout.
+func trapSignalsForShutdown(gracefulShutdown func(), reExecForUpgrade func()) {
 	c := make(chan os.Signal, 2)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGHUP)
-	<-c
-	go func() {
-		<-c
-		os.Exit(0)
-	}()
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+
+	for sig := range c {
+		if sig == syscall.SIGHUP || sig == syscall.SIGUSR2 {
+			reExecForUpgrade()
+			continue
+		}
+
+		go func() {
+			<-c
+			os.Exit(0)
+		}()
+
+		gracefulShutdown()
+		return
+	}
+}
+
+// listenFDEnvVar is set by a parent process re-exec'ing via reExec to tell
+// the child which inherited file descriptor it should listen on instead of
+// calling net.Listen itself.
+const listenFDEnvVar = "LSP_ADAPTER_LISTEN_FD"
+
+// listen returns the proxy's listener (tcp, unix, or stdio, per
+// -proxyAddress; see newProxyListener). If this process was started by a
+// live-reload re-exec (see reExec), it adopts the inherited listener file
+// descriptor instead of binding a new one, so the handoff is zero-downtime.
+func listen(addr string) (net.Listener, error) {
+	if fdStr := os.Getenv(listenFDEnvVar); fdStr != "" {
+		fd, err := strconv.Atoi(fdStr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s=%q", listenFDEnvVar, fdStr)
+		}
+
+		lis, err := net.FileListener(os.NewFile(uintptr(fd), "lsp-adapter-listener"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "adopting inherited listener fd %d failed", fd)
+		}
+		log.Printf("CloneProxy: inherited listener fd %d from parent", fd)
+		return lis, nil
+	}
+
+	return newProxyListener(addr)
+}
+
+// fileListener is implemented by *net.TCPListener and *net.UnixListener,
+// both of which can hand reExec a dup'd file descriptor to pass to a child
+// process. stdio:// listeners (stdioListener) don't implement this, since
+// there's no socket fd to inherit.
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+// reExec forks and execs a copy of this binary with the same arguments and
+// environment, handing it the already-bound listener so it can start
+// accepting connections immediately. This is modeled on the inetd/Teleport
+// fork+exec pattern: the parent keeps servicing in-flight sessions against
+// the old process while the child takes over new ones, giving operators a
+// way to upgrade the binary or change flags like -glob/-beforeInitializeHook
+// without dropping active editor sessions.
+func reExec(lis net.Listener) (*os.Process, error) {
+	fl, ok := lis.(fileListener)
+	if !ok {
+		return nil, errors.Errorf("live-reload requires a tcp or unix listener, got %T", lis)
+	}
+
+	lisFile, err := fl.File()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not dup listener fd")
+	}
+	defer lisFile.Close()
+
+	execPath, err := os.Executable()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not resolve executable path")
+	}
+
+	env := append(os.Environ(), fmt.Sprintf("%s=3", listenFDEnvVar))
+	child, err := os.StartProcess(execPath, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, lisFile},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "starting child process failed")
+	}
 
-	shutdown()
+	return child, nil
 }
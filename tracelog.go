@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// logLevel orders the severities a structuredLogger line can be emitted at.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelInfo:
+		return "info"
+	case levelWarn:
+		return "warn"
+	case levelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return levelDebug, nil
+	case "info":
+		return levelInfo, nil
+	case "warn", "warning":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	default:
+		return levelInfo, errors.Errorf("unknown -logLevel %q (want debug, info, warn, or error)", s)
+	}
+}
+
+// structuredLogger emits leveled log lines tagged with arbitrary key/value
+// fields, in either human-readable text or JSON (-logFormat), in place of
+// the bare log.Println calls used for per-session events elsewhere in the
+// proxy. Use rootLogger.with(...) to get a copy permanently tagged with a
+// sessionID, so every line it emits can be correlated back to one session
+// without repeating the ID at every call site.
+type structuredLogger struct {
+	out    io.Writer
+	level  logLevel
+	format string // "text" or "json"
+	fields map[string]interface{}
+}
+
+func newStructuredLogger(out io.Writer, level logLevel, format string) *structuredLogger {
+	return &structuredLogger{out: out, level: level, format: format}
+}
+
+// with returns a copy of l that additionally tags every line it emits with
+// key=value, e.g. rootLogger.with("sessionID", p.sessionID).
+func (l *structuredLogger) with(key string, value interface{}) *structuredLogger {
+	fields := make(map[string]interface{}, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return &structuredLogger{out: l.out, level: l.level, format: l.format, fields: fields}
+}
+
+// log writes one line at level, tagged with both l's permanent fields and
+// the kv pairs given here (key, value, key, value, ...). Lines below l's
+// configured -logLevel are dropped.
+func (l *structuredLogger) log(level logLevel, msg string, kv ...interface{}) {
+	if level < l.level {
+		return
+	}
+
+	fields := make(map[string]interface{}, len(l.fields)+len(kv)/2)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			continue
+		}
+		fields[key] = kv[i+1]
+	}
+
+	if l.format == "json" {
+		fields["level"] = level.String()
+		fields["msg"] = msg
+		fields["time"] = time.Now().Format(time.RFC3339Nano)
+		if err := json.NewEncoder(l.out).Encode(fields); err != nil {
+			fmt.Fprintf(l.out, "%s %s (failed to encode log line: %s)\n", level, msg, err)
+		}
+		return
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s", strings.ToUpper(level.String()), msg)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, fields[k])
+	}
+	fmt.Fprintln(l.out, b.String())
+}
+
+func (l *structuredLogger) Debugf(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv...) }
+func (l *structuredLogger) Infof(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv...) }
+func (l *structuredLogger) Warnf(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv...) }
+func (l *structuredLogger) Errorf(msg string, kv ...interface{}) { l.log(levelError, msg, kv...) }
+
+// rootLogger is the base structuredLogger every session's logger is derived
+// from via structuredLogger.with("sessionID", ...). It's replaced in main()
+// once -logLevel/-logFormat have been parsed; the default here only matters
+// for code paths that run before flag parsing finishes.
+var rootLogger = newStructuredLogger(os.Stderr, levelInfo, "text")
+
+// rpcEvent is one JSON-RPC exchange recorded into a session's event log
+// (see sessionEventLog), exposed as JSON by debugServer so misbehaving
+// language servers can be debugged in production without capturing full
+// stderr traces.
+type rpcEvent struct {
+	Time      time.Time `json:"time"`
+	Role      string    `json:"role"`      // "client" or "server": which side of the proxy this conn faces
+	Direction string    `json:"direction"` // "send" or "recv"
+	Method    string    `json:"method"`
+	ID        string    `json:"id,omitempty"`
+	LatencyMS float64   `json:"latencyMs,omitempty"` // only set on the "recv" event for a completed call
+	Err       string    `json:"error,omitempty"`
+}
+
+// sessionEventLog is a fixed-size ring buffer of the most recent rpcEvents
+// observed for one session. Older events are silently overwritten once it
+// fills; debugServer's /sessions/{id}/events endpoint is meant for "what
+// just happened", not a durable audit log.
+type sessionEventLog struct {
+	mu     sync.Mutex
+	events []rpcEvent
+	next   int
+	full   bool
+}
+
+func newSessionEventLog(capacity int) *sessionEventLog {
+	return &sessionEventLog{events: make([]rpcEvent, capacity)}
+}
+
+func (s *sessionEventLog) add(e rpcEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[s.next] = e
+	s.next = (s.next + 1) % len(s.events)
+	if s.next == 0 {
+		s.full = true
+	}
+}
+
+// snapshot returns the buffered events in the order they were recorded,
+// oldest first.
+func (s *sessionEventLog) snapshot() []rpcEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.full {
+		out := make([]rpcEvent, s.next)
+		copy(out, s.events[:s.next])
+		return out
+	}
+
+	out := make([]rpcEvent, len(s.events))
+	n := copy(out, s.events[s.next:])
+	copy(out[n:], s.events[:s.next])
+	return out
+}
+
+// eventLogs is the process-wide registry of per-session ring buffers,
+// populated in main()'s accept loop alongside the sessions map and served
+// by debugServer.
+var (
+	eventLogsMu sync.Mutex
+	eventLogs   = map[uuid.UUID]*sessionEventLog{}
+)
+
+// registerSessionEventLog creates and registers the ring buffer for a newly
+// accepted session. Callers must pair this with unregisterSessionEventLog
+// once the session ends.
+func registerSessionEventLog(sessionID uuid.UUID, capacity int) *sessionEventLog {
+	events := newSessionEventLog(capacity)
+	eventLogsMu.Lock()
+	eventLogs[sessionID] = events
+	eventLogsMu.Unlock()
+	return events
+}
+
+func unregisterSessionEventLog(sessionID uuid.UUID) {
+	eventLogsMu.Lock()
+	delete(eventLogs, sessionID)
+	eventLogsMu.Unlock()
+}
+
+// traceRequests returns a jsonrpc2.ConnOpt that logs every request,
+// notification, and response seen on the conn through rootLogger at debug
+// level (warn for error responses), tagged with sessionID. Unlike -trace's
+// raw jsonrpc2.LogMessages stderr dump, which is still installed separately
+// when -trace is set, these are leveled, structured lines that are practical
+// to filter and ship in production.
+func traceRequests(sessionID string) jsonrpc2.ConnOpt {
+	logger := rootLogger.with("sessionID", sessionID)
+
+	var mu sync.Mutex
+	sentAt := map[jsonrpc2.ID]time.Time{}
+
+	return func(c *jsonrpc2.Conn) {
+		jsonrpc2.OnSend(func(req *jsonrpc2.Request, resp *jsonrpc2.Response) {
+			switch {
+			case req != nil:
+				if !req.Notif {
+					mu.Lock()
+					sentAt[req.ID] = time.Now()
+					mu.Unlock()
+				}
+				logger.Debugf("send", "method", req.Method, "notif", req.Notif)
+			case resp != nil:
+				logger.Debugf("send", "method", "(response)", "id", resp.ID.String())
+			}
+		})(c)
+
+		jsonrpc2.OnRecv(func(req *jsonrpc2.Request, resp *jsonrpc2.Response) {
+			switch {
+			case req != nil:
+				logger.Debugf("recv", "method", req.Method, "notif", req.Notif)
+			case resp != nil:
+				mu.Lock()
+				start, ok := sentAt[resp.ID]
+				if ok {
+					delete(sentAt, resp.ID)
+				}
+				mu.Unlock()
+
+				kv := []interface{}{"method", "(response)", "id", resp.ID.String()}
+				if ok {
+					kv = append(kv, "latencyMs", time.Since(start).Seconds()*1000)
+				}
+				if resp.Error != nil {
+					logger.Warnf("recv", append(kv, "error", resp.Error.Message)...)
+				} else {
+					logger.Debugf("recv", kv...)
+				}
+			}
+		})(c)
+	}
+}
+
+// traceEventLog returns a jsonrpc2.ConnOpt that records every JSON-RPC
+// exchange on the conn into sessionID's ring buffer (see sessionEventLog),
+// tagged with role ("client" or "server", i.e. which side of the proxy the
+// conn faces) so /sessions/{id}/events can show both halves of a session's
+// traffic. A no-op if sessionID has no registered event log (e.g. it was
+// looked up before registerSessionEventLog ran, or has already ended).
+func traceEventLog(role, sessionID string) jsonrpc2.ConnOpt {
+	id, err := uuid.Parse(sessionID)
+	if err != nil {
+		rootLogger.Errorf("traceEventLog: invalid sessionID, not recording events", "sessionID", sessionID, "error", err)
+		return func(*jsonrpc2.Conn) {}
+	}
+
+	eventLogsMu.Lock()
+	events := eventLogs[id]
+	eventLogsMu.Unlock()
+	if events == nil {
+		return func(*jsonrpc2.Conn) {}
+	}
+
+	var mu sync.Mutex
+	sentAt := map[jsonrpc2.ID]time.Time{}
+
+	return func(c *jsonrpc2.Conn) {
+		jsonrpc2.OnSend(func(req *jsonrpc2.Request, resp *jsonrpc2.Response) {
+			switch {
+			case req != nil:
+				if !req.Notif {
+					mu.Lock()
+					sentAt[req.ID] = time.Now()
+					mu.Unlock()
+				}
+				events.add(rpcEvent{Time: time.Now(), Role: role, Direction: "send", Method: req.Method})
+			case resp != nil:
+				e := rpcEvent{Time: time.Now(), Role: role, Direction: "send", Method: "(response)", ID: resp.ID.String()}
+				if resp.Error != nil {
+					e.Err = resp.Error.Message
+				}
+				events.add(e)
+			}
+		})(c)
+
+		jsonrpc2.OnRecv(func(req *jsonrpc2.Request, resp *jsonrpc2.Response) {
+			switch {
+			case req != nil:
+				events.add(rpcEvent{Time: time.Now(), Role: role, Direction: "recv", Method: req.Method})
+			case resp != nil:
+				mu.Lock()
+				start, ok := sentAt[resp.ID]
+				if ok {
+					delete(sentAt, resp.ID)
+				}
+				mu.Unlock()
+
+				e := rpcEvent{Time: time.Now(), Role: role, Direction: "recv", Method: "(response)", ID: resp.ID.String()}
+				if ok {
+					e.LatencyMS = time.Since(start).Seconds() * 1000
+				}
+				if resp.Error != nil {
+					e.Err = resp.Error.Message
+				}
+				events.add(e)
+			}
+		})(c)
+	}
+}
+
+// debugServer serves pprof profiles and the per-session JSON-RPC event log
+// at addr (-pprofAddr). It's a separate listener from the proxy's own
+// -proxyAddress, since it's meant for operators rather than editor clients.
+func debugServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/sessions/", serveSessionEvents)
+	if *metricsAddr == "" {
+		// No separate -metricsAddr configured: serve /metrics here too.
+		mountMetricsHandler(mux)
+	}
+
+	log.Printf("CloneProxy: debug server listening at %s (pprof under /debug/pprof/, JSON-RPC event logs under /sessions/{sessionID}/events)", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Println("CloneProxy: debug server failed:", err)
+	}
+}
+
+// serveSessionEvents handles GET /sessions/{sessionID}/events, returning
+// the session's ring buffer of recent JSON-RPC exchanges as a JSON array,
+// oldest first.
+func serveSessionEvents(w http.ResponseWriter, r *http.Request) {
+	sessionIDStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/events")
+	if sessionIDStr == "" || sessionIDStr == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	sessionID, err := uuid.Parse(sessionIDStr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid session id %q", sessionIDStr), http.StatusBadRequest)
+		return
+	}
+
+	eventLogsMu.Lock()
+	events := eventLogs[sessionID]
+	eventLogsMu.Unlock()
+	if events == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events.snapshot()); err != nil {
+		log.Println("CloneProxy: encoding session event log failed:", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// splitTransportURI splits a transport URI like "tcp://host:port",
+// "unix:///run/foo.sock", or "stdio://" into its scheme and address. A bare
+// address with no "://" (the legacy default for -proxyAddress, e.g.
+// "127.0.0.1:8080") is returned with an empty scheme, which callers treat as
+// "tcp" for backwards compatibility.
+func splitTransportURI(raw string) (scheme, address string) {
+	if i := strings.Index(raw, "://"); i >= 0 {
+		return raw[:i], raw[i+len("://"):]
+	}
+	return "", raw
+}
+
+// newProxyListener creates the listener the proxy accepts client connections
+// on, based on the scheme of -proxyAddress: "tcp://host:port" or a bare
+// "host:port" for TCP, "unix:///path/to.sock" for a Unix domain socket, and
+// "stdio://" to expose the adapter itself over this process's stdin/stdout
+// (the common invocation pattern for editors like VSCode or Neovim that
+// spawn language servers as subprocesses).
+func newProxyListener(rawAddr string) (net.Listener, error) {
+	scheme, address := splitTransportURI(rawAddr)
+	switch scheme {
+	case "", "tcp":
+		lis, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, errors.Wrap(err, "setting up tcp proxy listener failed")
+		}
+		return lis, nil
+	case "unix":
+		// Best-effort removal of a stale socket file left behind by a
+		// previous, uncleanly-terminated process.
+		os.Remove(address)
+		lis, err := net.Listen("unix", address)
+		if err != nil {
+			return nil, errors.Wrap(err, "setting up unix proxy listener failed")
+		}
+		return lis, nil
+	case "stdio":
+		return newStdioListener(), nil
+	default:
+		return nil, errors.Errorf("unsupported -proxyAddress scheme %q", scheme)
+	}
+}
+
+// connectToLanguageServer establishes the connection to the backend language
+// server. By default lspBin is a command to fork as a subprocess, speaking
+// LSP over its stdio. Symmetrically with -proxyAddress, lspBin may instead be
+// a single "tcp://host:port" or "unix:///path/to.sock" URI, in which case the
+// adapter dials an already-running language server daemon rather than
+// spawning one per client.
+func connectToLanguageServer(ctx context.Context, lspBin []string) (io.ReadWriteCloser, error) {
+	if len(lspBin) == 1 {
+		if scheme, address := splitTransportURI(lspBin[0]); scheme == "tcp" || scheme == "unix" {
+			conn, err := net.Dial(scheme, address)
+			if err != nil {
+				return nil, errors.Wrapf(err, "dialing language server at %s failed", lspBin[0])
+			}
+			return conn, nil
+		}
+	}
+
+	return stdIoLSConn(ctx, lspBin[0], lspBin[1:]...)
+}
+
+// stdioAddr is the net.Addr reported by stdioConn/stdioListener.
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// stdioConn adapts this process's stdin/stdout to a net.Conn so it can be
+// handled like any other client connection by cloneProxy.
+type stdioConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdioConn) Close() error                       { return nil }
+func (stdioConn) LocalAddr() net.Addr                { return stdioAddr{} }
+func (stdioConn) RemoteAddr() net.Addr               { return stdioAddr{} }
+func (stdioConn) SetDeadline(t time.Time) error      { return nil }
+func (stdioConn) SetReadDeadline(t time.Time) error  { return nil }
+func (stdioConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// stdioListener is a net.Listener that yields exactly one connection, backed
+// by this process's stdin/stdout, and then blocks future Accept calls until
+// it is closed. This lets -proxyAddress=stdio:// reuse the same accept-loop
+// code path as the tcp/unix listeners, serving a single editor session per
+// process invocation.
+type stdioListener struct {
+	accepted chan struct{}
+	closed   chan struct{}
+	closeOne sync.Once
+}
+
+func newStdioListener() *stdioListener {
+	l := &stdioListener{
+		accepted: make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+	l.accepted <- struct{}{}
+	return l
+}
+
+func (l *stdioListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.accepted:
+		return stdioConn{Reader: os.Stdin, Writer: os.Stdout}, nil
+	case <-l.closed:
+		return nil, errors.New("stdio listener closed")
+	}
+}
+
+func (l *stdioListener) Close() error {
+	l.closeOne.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *stdioListener) Addr() net.Addr { return stdioAddr{} }